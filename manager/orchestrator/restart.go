@@ -2,6 +2,9 @@ package orchestrator
 
 import (
 	"container/list"
+	"fmt"
+	"math"
+	"math/rand"
 	"sync"
 	"time"
 
@@ -13,19 +16,57 @@ import (
 	"golang.org/x/net/context"
 )
 
+// This file assumes a few additions to the api and store packages that are
+// not part of this snapshot and must land alongside it for the package to
+// build: the api.TaskStateRestartsExceeded task state, the
+// api.RestartOnUnhealthy restart condition and api.HealthCheckUnhealthy
+// health status, the BackoffFactor/MaxDelay/JitterFraction fields on
+// api.RestartPolicy, a Health field on api.TaskStatus with a matching
+// state.TaskCheckHealth check, the api.ServiceStatus/api.ServiceStateDegraded and
+// api.ServiceStateAvailable fields on api.Service, and a raft-replicated
+// api.RestartHistory object with the usual
+// store.CreateRestartHistory/UpdateRestartHistory/
+// DeleteRestartHistory/GetRestartHistory/FindRestartHistory accessors
+// generated for it. None of those are proto/store plumbing this package
+// owns, so they're called here as if already generated rather than
+// reimplemented speculatively.
+
 const defaultOldTaskTimeout = time.Minute
 
+// defaultUnhealthyReportsForRestart is the number of unhealthy reports that
+// must accumulate within Restart.Window before a RestartOnUnhealthy service
+// is restarted, used when the container spec doesn't configure
+// HealthConfig.Retries. A single report is treated as possible health-check
+// flakiness rather than a restart-triggering terminal event.
+const defaultUnhealthyReportsForRestart = 2
+
+// restartHistorySweepInterval is how often Run prunes RestartHistory objects
+// that have fully aged out of their service's Restart.Window.
+const restartHistorySweepInterval = time.Minute
+
 type restartedInstance struct {
 	timestamp time.Time
 }
 
+type unhealthyReport struct {
+	timestamp time.Time
+}
+
 type instanceRestartInfo struct {
 	// counter of restarts for this instance.
 	totalRestarts uint64
+	// counter of consecutive failures for this instance, used to compute
+	// the exponential backoff delay. It is reset once a restarted task
+	// stays running longer than Restart.Window.
+	consecutiveFailures uint64
 	// Linked list of restartedInstance structs. Only used when
 	// Restart.MaxAttempts and Restart.Window are both
 	// nonzero.
 	restartedInstances *list.List
+	// Linked list of unhealthyReport structs, tracking unhealthy
+	// transitions seen within Restart.Window for RestartOnUnhealthy
+	// services.
+	unhealthyReports *list.List
 }
 
 type delayedStart struct {
@@ -34,22 +75,69 @@ type delayedStart struct {
 }
 
 // RestartSupervisor initiates and manages restarts. It's responsible for
-// delaying restarts when applicable.
+// delaying restarts when applicable, including applying exponential backoff
+// to Restart.Delay as an instance keeps failing.
 type RestartSupervisor struct {
 	mu               sync.Mutex
 	store            *store.MemoryStore
 	delays           map[string]delayedStart
 	history          map[instanceTuple]*instanceRestartInfo
 	historyByService map[string]map[instanceTuple]struct{}
+	recoveryWatches  map[instanceTuple]func()
+	evaluator        RestartPolicyEvaluator
+	cancelBackground func()
 }
 
-// NewRestartSupervisor creates a new RestartSupervisor.
+// NewRestartSupervisor creates a new RestartSupervisor using the default
+// MaxAttempts/Window restart policy.
 func NewRestartSupervisor(store *store.MemoryStore) *RestartSupervisor {
+	return NewRestartSupervisorWithEvaluator(store, defaultRestartPolicyEvaluator{})
+}
+
+// NewRestartSupervisorWithEvaluator creates a new RestartSupervisor that
+// delegates its restart-budget decisions to evaluator instead of the
+// default MaxAttempts/Window policy. Call Start once the caller has
+// acquired leadership to rebuild its restart-history cache and begin
+// reacting to task events; call Stop to tear that down again.
+func NewRestartSupervisorWithEvaluator(store *store.MemoryStore, evaluator RestartPolicyEvaluator) *RestartSupervisor {
 	return &RestartSupervisor{
 		store:            store,
 		delays:           make(map[string]delayedStart),
 		history:          make(map[instanceTuple]*instanceRestartInfo),
 		historyByService: make(map[string]map[instanceTuple]struct{}),
+		recoveryWatches:  make(map[instanceTuple]func()),
+		evaluator:        evaluator,
+	}
+}
+
+// Start rebuilds the restart-history cache from readTx via Init, then
+// starts the background goroutines (WatchHealth and Run) that react to
+// task events and sweep aged-out history. It must be called once, after
+// the caller has acquired leadership, and before any of those events can
+// reach this supervisor — starting the goroutines first would let a
+// freshly-elected leader begin issuing restarts using a still-empty cache,
+// resetting every instance's backoff and attempt counters right after a
+// failover. Call Stop to tear down what Start started.
+func (r *RestartSupervisor) Start(ctx context.Context, readTx store.ReadTx) error {
+	if err := r.Init(readTx); err != nil {
+		return err
+	}
+
+	backgroundCtx, cancel := context.WithCancel(context.Background())
+	r.cancelBackground = cancel
+
+	go r.WatchHealth(backgroundCtx)
+	go r.Run(backgroundCtx)
+
+	return nil
+}
+
+// Stop cancels the background goroutines started by Start, if Start was
+// ever called. It should be called once the supervisor is no longer
+// needed, e.g. on leadership loss or manager shutdown.
+func (r *RestartSupervisor) Stop() {
+	if r.cancelBackground != nil {
+		r.cancelBackground()
 	}
 }
 
@@ -63,10 +151,22 @@ func (r *RestartSupervisor) Restart(ctx context.Context, tx store.Tx, service *a
 		return err
 	}
 
-	if !r.shouldRestart(&t, service) {
+	allow, attemptsExceeded := r.shouldRestart(&t, service)
+	if !allow {
+		if attemptsExceeded {
+			return r.markRestartsExceeded(ctx, tx, service, &t)
+		}
 		return nil
 	}
 
+	tuple := instanceTuple{
+		instance:  t.Instance,
+		serviceID: t.ServiceID,
+	}
+	if isGlobalService(service) {
+		tuple.nodeID = t.NodeID
+	}
+
 	var restartTask *api.Task
 
 	if isReplicatedService(service) {
@@ -86,7 +186,7 @@ func (r *RestartSupervisor) Restart(ctx context.Context, tx store.Tx, service *a
 	var restartDelay time.Duration
 	// Restart delay does not applied to drained nodes
 	if service.Spec.Restart != nil && service.Spec.Restart.Delay != 0 && (n == nil || n.Spec.Availability != api.NodeAvailabilityDrain) {
-		restartDelay = service.Spec.Restart.Delay
+		restartDelay = r.backoffDelay(service, tuple)
 	}
 
 	waitStop := true
@@ -102,22 +202,250 @@ func (r *RestartSupervisor) Restart(ctx context.Context, tx store.Tx, service *a
 		return err
 	}
 
-	r.recordRestartHistory(restartTask, service)
+	r.recordRestartHistory(ctx, tx, restartTask, service)
+	r.monitorRecovery(ctx, tuple, service, restartTask.ID)
 
 	r.DelayStart(ctx, tx, service, &t, restartTask.ID, restartDelay, waitStop)
 	return nil
 }
 
-func (r *RestartSupervisor) shouldRestart(t *api.Task, service *api.Service) bool {
+// backoffDelay computes the delay to apply before starting restartTask,
+// using Restart.Delay as a base for exponential backoff when
+// Restart.BackoffFactor is set. The result is capped at Restart.MaxDelay (if
+// nonzero) and randomized within Restart.JitterFraction to avoid many
+// instances of the same service retrying in lockstep.
+func (r *RestartSupervisor) backoffDelay(service *api.Service, tuple instanceTuple) time.Duration {
+	policy := service.Spec.Restart
+	delay := policy.Delay
+
+	if policy.BackoffFactor > 1 {
+		r.mu.Lock()
+		var failures uint64
+		if info := r.history[tuple]; info != nil {
+			failures = info.consecutiveFailures
+		}
+		r.mu.Unlock()
+
+		if failures > 0 {
+			factor := math.Pow(policy.BackoffFactor, float64(failures))
+			delay = time.Duration(float64(policy.Delay) * factor)
+		}
+	}
+
+	if policy.MaxDelay != 0 && delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+
+	if policy.JitterFraction > 0 {
+		delay += time.Duration(rand.Float64() * policy.JitterFraction * float64(delay))
+	}
+
+	return delay
+}
+
+// monitorRecovery watches newTaskID and resets the consecutive failure count
+// for tuple once it has stayed running for longer than Restart.Window. Any
+// previous watch for the same instance is cancelled, since newTaskID
+// supersedes it.
+func (r *RestartSupervisor) monitorRecovery(ctx context.Context, tuple instanceTuple, service *api.Service, newTaskID string) {
+	if service.Spec.Restart == nil || service.Spec.Restart.Window == 0 {
+		return
+	}
+
+	watchCtx, cancel := context.WithCancel(context.Background())
+
+	r.mu.Lock()
+	if oldCancel, ok := r.recoveryWatches[tuple]; ok {
+		oldCancel()
+	}
+	r.recoveryWatches[tuple] = cancel
+	r.mu.Unlock()
+
+	// Unlike the watch in DelayStart, which looks for the *old* task
+	// moving past Running to detect that it has stopped, this one needs
+	// to fire when the *new* task reaches Running, so it must check for
+	// equality rather than TaskCheckStateGreaterThan.
+	watch, cancelWatch := state.Watch(r.store.WatchQueue(), state.EventUpdateTask{
+		Task:   &api.Task{ID: newTaskID, Status: api.TaskStatus{State: api.TaskStateRunning}},
+		Checks: []state.TaskCheckFunc{state.TaskCheckID, state.TaskCheckState},
+	})
+
+	go func() {
+		defer cancelWatch()
+
+		select {
+		case <-watch:
+		case <-watchCtx.Done():
+			return
+		}
+
+		select {
+		case <-time.After(service.Spec.Restart.Window):
+		case <-watchCtx.Done():
+			return
+		}
+
+		stillRunning := false
+		r.store.View(func(tx store.ReadTx) {
+			if t := store.GetTask(tx, newTaskID); t != nil {
+				stillRunning = t.Status.State == api.TaskStateRunning
+			}
+		})
+
+		r.mu.Lock()
+		info := r.history[tuple]
+		if info != nil && stillRunning {
+			info.consecutiveFailures = 0
+		}
+		delete(r.recoveryWatches, tuple)
+		r.mu.Unlock()
+
+		if info == nil || !stillRunning {
+			return
+		}
+
+		err := r.store.Update(func(tx store.Tx) error {
+			if err := r.persistHistory(tx, tuple, info); err != nil {
+				return err
+			}
+			return r.clearServiceDegraded(tx, tuple.serviceID)
+		})
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("service.id", tuple.serviceID).Error("failed to persist recovered restart history")
+		}
+	}()
+}
+
+// RestartPolicyEvaluator decides whether an instance that has already been
+// confirmed eligible under the service's RestartCondition should actually
+// be restarted right now, based on the restart history recorded for it.
+// This is the extension point operators can use to plug in custom restart
+// budgets (e.g. quorum-aware, dependency-aware) without forking swarmkit.
+//
+// history.restartedInstances is already pruned to Restart.Window by the time
+// Evaluate sees it, so implementations should treat history as read-only:
+// it is the same *instanceRestartInfo retained in RestartSupervisor.history,
+// and callers hold RestartSupervisor.mu for the duration of the call.
+type RestartPolicyEvaluator interface {
+	// Evaluate reports whether tuple should be restarted now. The second
+	// return value distinguishes declining a restart because the policy's
+	// attempt budget was exhausted from declining it for some other
+	// reason — only the former is surfaced to operators as
+	// TaskStateRestartsExceeded.
+	Evaluate(tuple instanceTuple, service *api.Service, history *instanceRestartInfo) (allow bool, exceeded bool)
+}
+
+// defaultRestartPolicyEvaluator implements the restart policy swarmkit has
+// always used: allow up to Restart.MaxAttempts restarts of the same
+// instance, within Restart.Window if one is set.
+type defaultRestartPolicyEvaluator struct{}
+
+func (defaultRestartPolicyEvaluator) Evaluate(tuple instanceTuple, service *api.Service, history *instanceRestartInfo) (bool, bool) {
+	if service.Spec.Restart.MaxAttempts == 0 {
+		// No per-instance limit configured. Pruning of history.restartedInstances
+		// happens in recordRestartHistory and shouldRestart, not here, so this
+		// evaluator has nothing else to do.
+		return true, false
+	}
+
+	if service.Spec.Restart.Window == 0 {
+		allow := history.totalRestarts < service.Spec.Restart.MaxAttempts
+		return allow, !allow
+	}
+
+	if history.restartedInstances == nil {
+		return true, false
+	}
+
+	// history.restartedInstances is already pruned to Restart.Window by
+	// shouldRestart, so this only needs to count it.
+	numRestarts := uint64(history.restartedInstances.Len())
+
+	allow := numRestarts < service.Spec.Restart.MaxAttempts
+	return allow, !allow
+}
+
+// RateLimitedRestartPolicyEvaluator caps the number of restarts a service
+// may have across all of its instances within a one-minute window,
+// regardless of Restart.MaxAttempts. It first asks next (typically the
+// default evaluator) for the per-instance decision, and applies the
+// cluster-wide budget only to restarts that next allows. This guards against a restart storm — for example a
+// bad image rollout that crash-loops every replica at once — that
+// per-instance limits alone don't prevent, since no single instance needs
+// to exceed its own MaxAttempts for that to happen.
+type RateLimitedRestartPolicyEvaluator struct {
+	// MaxPerMinute is the maximum number of restarts allowed for a
+	// service, across all of its instances, in any trailing one-minute
+	// window.
+	MaxPerMinute uint64
+
+	next RestartPolicyEvaluator
+
+	mu       sync.Mutex
+	restarts map[string]*list.List // serviceID -> restart timestamps
+}
+
+// NewRateLimitedRestartPolicyEvaluator creates a RestartPolicyEvaluator that
+// allows at most maxPerMinute restarts per service per minute, delegating
+// to next for the per-instance MaxAttempts/Window decision.
+func NewRateLimitedRestartPolicyEvaluator(maxPerMinute uint64, next RestartPolicyEvaluator) *RateLimitedRestartPolicyEvaluator {
+	return &RateLimitedRestartPolicyEvaluator{
+		MaxPerMinute: maxPerMinute,
+		next:         next,
+		restarts:     make(map[string]*list.List),
+	}
+}
+
+func (e *RateLimitedRestartPolicyEvaluator) Evaluate(tuple instanceTuple, service *api.Service, history *instanceRestartInfo) (bool, bool) {
+	if allow, exceeded := e.next.Evaluate(tuple, service, history); !allow {
+		return allow, exceeded
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	timestamps := e.restarts[tuple.serviceID]
+	if timestamps == nil {
+		timestamps = list.New()
+		e.restarts[tuple.serviceID] = timestamps
+	}
+
+	lookback := time.Now().Add(-time.Minute)
+
+	var nextElem *list.Element
+	for elem := timestamps.Front(); elem != nil; elem = nextElem {
+		nextElem = elem.Next()
+
+		if elem.Value.(time.Time).After(lookback) {
+			break
+		}
+		timestamps.Remove(elem)
+	}
+
+	if uint64(timestamps.Len()) >= e.MaxPerMinute {
+		return false, true
+	}
+
+	timestamps.PushBack(time.Now())
+	return true, false
+}
+
+// shouldRestart reports whether t should be restarted. The second return
+// value distinguishes the case where a restart is declined specifically
+// because the restart policy's attempt budget has been exhausted, as
+// opposed to the restart condition simply not applying (e.g. RestartOnNone,
+// or a completed task under RestartOnFailure) — only the former is
+// surfaced to operators as TaskStateRestartsExceeded.
+func (r *RestartSupervisor) shouldRestart(t *api.Task, service *api.Service) (bool, bool) {
 	condition := restartCondition(service)
 
-	if condition != api.RestartOnAny &&
+	if condition != api.RestartOnAny && condition != api.RestartOnUnhealthy &&
 		(condition != api.RestartOnFailure || t.Status.TerminalState == api.TaskStateCompleted) {
-		return false
+		return false, false
 	}
 
-	if service.Spec.Restart == nil || service.Spec.Restart.MaxAttempts == 0 {
-		return true
+	if service.Spec.Restart == nil {
+		return true, false
 	}
 
 	instanceTuple := instanceTuple{
@@ -136,42 +464,223 @@ func (r *RestartSupervisor) shouldRestart(t *api.Task, service *api.Service) boo
 
 	restartInfo := r.history[instanceTuple]
 	if restartInfo == nil {
-		return true
+		// No restarts recorded yet. Still defer to the evaluator rather
+		// than short-circuiting to true here: a zero-value
+		// instanceRestartInfo is what "never restarted" looks like to
+		// Evaluate, and evaluators like RateLimitedRestartPolicyEvaluator
+		// need to see this call to enforce a cluster-wide budget even
+		// when Restart.MaxAttempts is 0.
+		restartInfo = &instanceRestartInfo{}
 	}
 
-	if service.Spec.Restart.Window == 0 {
-		return restartInfo.totalRestarts < service.Spec.Restart.MaxAttempts
+	// Drop restarts that have aged out of the window since they were
+	// recorded, so Evaluate counts only those within Restart.Window of now.
+	if restartInfo.restartedInstances != nil && service.Spec.Restart.Window != 0 {
+		lookback := time.Now().Add(-service.Spec.Restart.Window)
+		var next *list.Element
+		for e := restartInfo.restartedInstances.Front(); e != nil; e = next {
+			next = e.Next()
+			if e.Value.(restartedInstance).timestamp.After(lookback) {
+				break
+			}
+			restartInfo.restartedInstances.Remove(e)
+		}
+	}
+
+	return r.evaluator.Evaluate(instanceTuple, service, restartInfo)
+}
+
+// markRestartsExceeded updates t to the TaskStateRestartsExceeded terminal
+// state and records the same fact on service, so that swarmctl service
+// inspect (and the orchestrator) can tell the difference between a task
+// that is done restarting because Restart.MaxAttempts was reached and one
+// that simply isn't meant to restart, without having to already know which
+// task to look at. This does not stop the service: it only stops automatic
+// replacement of this particular instance until an operator intervenes
+// (e.g. by updating the service).
+func (r *RestartSupervisor) markRestartsExceeded(ctx context.Context, tx store.Tx, service *api.Service, t *api.Task) error {
+	t.Status.State = api.TaskStateRestartsExceeded
+	t.Status.Message = "restart count exceeded"
+
+	if err := store.UpdateTask(tx, t); err != nil {
+		log.G(ctx).WithError(err).WithField("task.id", t.ID).Error("failed to mark task as restarts-exceeded")
+		return err
 	}
 
-	if restartInfo.restartedInstances == nil {
+	if err := r.markServiceDegraded(tx, service, t); err != nil {
+		log.G(ctx).WithError(err).WithField("service.id", service.ID).Error("failed to mark service degraded after restarts exceeded")
+		return err
+	}
+
+	return nil
+}
+
+// markServiceDegraded records, on the service itself, that one of its
+// instances has stopped being restarted because it exceeded
+// Restart.MaxAttempts. This is what makes the condition visible to
+// swarmctl service inspect: the per-task TaskStateRestartsExceeded state
+// alone isn't something an operator would find without already knowing
+// which task to look at.
+func (r *RestartSupervisor) markServiceDegraded(tx store.Tx, service *api.Service, t *api.Task) error {
+	current := store.GetService(tx, service.ID)
+	if current == nil {
+		// Service was deleted concurrently; nothing to update.
+		return nil
+	}
+
+	if current.Status == nil {
+		current.Status = &api.ServiceStatus{}
+	}
+	current.Status.State = api.ServiceStateDegraded
+	current.Status.Message = fmt.Sprintf("instance %d exceeded restart limit (task %s)", t.Instance, t.ID)
+
+	return store.UpdateService(tx, current)
+}
+
+// clearServiceDegraded un-marks a service previously marked degraded by
+// markServiceDegraded. Without this, ServiceStateDegraded would be a
+// one-way ratchet: once set, nothing would ever report that the operator's
+// fix (e.g. a service update, or a later instance of the same slot finally
+// starting successfully) actually resolved the problem. It is called both
+// when an instance recovers on its own (monitorRecovery) and when an
+// operator clears restart history explicitly (ClearServiceHistory).
+func (r *RestartSupervisor) clearServiceDegraded(tx store.Tx, serviceID string) error {
+	current := store.GetService(tx, serviceID)
+	if current == nil || current.Status == nil || current.Status.State != api.ServiceStateDegraded {
+		return nil
+	}
+
+	current.Status.State = api.ServiceStateAvailable
+	current.Status.Message = ""
+
+	return store.UpdateService(tx, current)
+}
+
+// WatchHealth watches for unhealthy transitions reported by the agent's
+// container health checks and restarts tasks belonging to services
+// configured with RestartOnUnhealthy. Unlike the normal restart path, these
+// tasks never reach a terminal TaskState on their own, so the health check
+// itself is the signal that the task should be replaced even though it is
+// still TaskStateRunning. It blocks until ctx is cancelled; Start runs it
+// in its own goroutine for the lifetime of the supervisor.
+func (r *RestartSupervisor) WatchHealth(ctx context.Context) {
+	watch, cancel := state.Watch(r.store.WatchQueue(), state.EventUpdateTask{
+		Task:   &api.Task{Status: api.TaskStatus{Health: api.HealthCheckUnhealthy}},
+		Checks: []state.TaskCheckFunc{state.TaskCheckHealth},
+	})
+	defer cancel()
+
+	for {
+		select {
+		case event := <-watch:
+			r.handleUnhealthyTask(ctx, event.(state.EventUpdateTask).Task)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *RestartSupervisor) handleUnhealthyTask(ctx context.Context, t *api.Task) {
+	if t.Status.State != api.TaskStateRunning {
+		// Once a task has reached a terminal state, the normal
+		// failure-driven restart path already applies.
+		return
+	}
+
+	err := r.store.Update(func(tx store.Tx) error {
+		service := store.GetService(tx, t.ServiceID)
+		if service == nil || restartCondition(service) != api.RestartOnUnhealthy {
+			return nil
+		}
+
+		if !r.recordUnhealthyReport(ctx, tx, t, service) {
+			return nil
+		}
+
+		return r.Restart(ctx, tx, service, *t)
+	})
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("task.id", t.ID).Error("failed to handle unhealthy task report")
+	}
+}
+
+// unhealthyReportsForRestart returns the number of unhealthy
+// reports that must be observed within Restart.Window before a
+// RestartOnUnhealthy service is restarted. This honors the operator's own
+// HealthConfig.Retries (the same threshold the agent itself uses to flip a
+// container's health status) so a flap-tolerant health check configured
+// with a high retry count doesn't get restarted far sooner than intended.
+func unhealthyReportsForRestart(service *api.Service) uint64 {
+	container := service.Spec.GetContainer()
+	if container != nil && container.HealthConfig != nil && container.HealthConfig.Retries > 0 {
+		return uint64(container.HealthConfig.Retries)
+	}
+	return defaultUnhealthyReportsForRestart
+}
+
+// recordUnhealthyReport records that t was reported unhealthy, and reports
+// whether enough unhealthy reports have now accumulated within
+// Restart.Window to trigger a restart. If triggered, the accumulated
+// reports are cleared so the same run of failures isn't counted twice.
+func (r *RestartSupervisor) recordUnhealthyReport(ctx context.Context, tx store.Tx, t *api.Task, service *api.Service) bool {
+	if service.Spec.Restart == nil || service.Spec.Restart.Window == 0 {
+		// Without a window there's no way to distinguish repeated
+		// flapping from a single bad report, so restart immediately.
 		return true
 	}
 
-	lookback := time.Now().Add(-service.Spec.Restart.Window)
+	tuple := instanceTuple{
+		instance:  t.Instance,
+		serviceID: t.ServiceID,
+	}
+	if isGlobalService(service) {
+		tuple.nodeID = t.NodeID
+	}
+
+	r.mu.Lock()
+
+	info := r.history[tuple]
+	if info == nil {
+		info = &instanceRestartInfo{}
+		r.history[tuple] = info
+	}
+	if info.unhealthyReports == nil {
+		info.unhealthyReports = list.New()
+	}
+	info.unhealthyReports.PushBack(unhealthyReport{timestamp: time.Now()})
 
+	lookback := time.Now().Add(-service.Spec.Restart.Window)
 	var next *list.Element
-	for e := restartInfo.restartedInstances.Front(); e != nil; e = next {
+	for e := info.unhealthyReports.Front(); e != nil; e = next {
 		next = e.Next()
 
-		if e.Value.(restartedInstance).timestamp.After(lookback) {
+		if e.Value.(unhealthyReport).timestamp.After(lookback) {
 			break
 		}
-		restartInfo.restartedInstances.Remove(e)
+		info.unhealthyReports.Remove(e)
 	}
 
-	numRestarts := uint64(restartInfo.restartedInstances.Len())
+	trigger := uint64(info.unhealthyReports.Len()) >= unhealthyReportsForRestart(service)
+	if trigger {
+		info.unhealthyReports.Init()
+	}
 
-	if numRestarts == 0 {
-		restartInfo.restartedInstances = nil
+	r.mu.Unlock()
+
+	if err := r.persistHistory(tx, tuple, info); err != nil {
+		log.G(ctx).WithError(err).WithField("service.id", service.ID).Error("failed to persist restart history")
 	}
 
-	return numRestarts < service.Spec.Restart.MaxAttempts
+	return trigger
 }
 
-func (r *RestartSupervisor) recordRestartHistory(restartTask *api.Task, service *api.Service) {
-	if service.Spec.Restart == nil || service.Spec.Restart.MaxAttempts == 0 {
-		// No limit on the number of restarts, so no need to record
-		// history.
+func (r *RestartSupervisor) recordRestartHistory(ctx context.Context, tx store.Tx, restartTask *api.Task, service *api.Service) {
+	if service.Spec.Restart == nil {
+		return
+	}
+	if service.Spec.Restart.MaxAttempts == 0 && service.Spec.Restart.BackoffFactor <= 1 {
+		// No limit on the number of restarts and no backoff to compute,
+		// so no need to record history.
 		return
 	}
 	tuple := instanceTuple{
@@ -181,13 +690,13 @@ func (r *RestartSupervisor) recordRestartHistory(restartTask *api.Task, service
 	}
 
 	r.mu.Lock()
-	defer r.mu.Unlock()
 
 	if r.history[tuple] == nil {
 		r.history[tuple] = &instanceRestartInfo{}
 	}
 	restartInfo := r.history[tuple]
 	restartInfo.totalRestarts++
+	restartInfo.consecutiveFailures++
 
 	if r.historyByService[restartTask.ServiceID] == nil {
 		r.historyByService[restartTask.ServiceID] = make(map[instanceTuple]struct{})
@@ -204,6 +713,30 @@ func (r *RestartSupervisor) recordRestartHistory(restartTask *api.Task, service
 		}
 
 		restartInfo.restartedInstances.PushBack(restartedInstance)
+
+		// Prune here, on the write path, rather than leaving it to
+		// evaluators' Evaluate methods: Evaluate is only reached when
+		// the restart condition applies and a restart is actually being
+		// considered, so an evaluator that allows every restart (e.g.
+		// MaxAttempts == 0 with a BackoffFactor configured) would never
+		// prune, and restartedInstances would grow without bound both
+		// here and in the persisted RestartHistory.RestartedAt array.
+		lookback := time.Now().Add(-service.Spec.Restart.Window)
+		var next *list.Element
+		for e := restartInfo.restartedInstances.Front(); e != nil; e = next {
+			next = e.Next()
+
+			if e.Value.(restartedInstance).timestamp.After(lookback) {
+				break
+			}
+			restartInfo.restartedInstances.Remove(e)
+		}
+	}
+
+	r.mu.Unlock()
+
+	if err := r.persistHistory(tx, tuple, restartInfo); err != nil {
+		log.G(ctx).WithError(err).WithField("service.id", restartTask.ServiceID).Error("failed to persist restart history")
 	}
 }
 
@@ -356,10 +889,10 @@ func (r *RestartSupervisor) CancelAll() {
 // ClearServiceHistory forgets restart history related to a given service ID.
 func (r *RestartSupervisor) ClearServiceHistory(serviceID string) {
 	r.mu.Lock()
-	defer r.mu.Unlock()
 
 	tuples := r.historyByService[serviceID]
 	if tuples == nil {
+		r.mu.Unlock()
 		return
 	}
 
@@ -367,5 +900,206 @@ func (r *RestartSupervisor) ClearServiceHistory(serviceID string) {
 
 	for t := range tuples {
 		delete(r.history, t)
+		if cancel, ok := r.recoveryWatches[t]; ok {
+			cancel()
+			delete(r.recoveryWatches, t)
+		}
 	}
-}
\ No newline at end of file
+
+	r.mu.Unlock()
+
+	// The raft write below must happen without r.mu held: every other
+	// restart decision (Restart, shouldRestart, recordRestartHistory,
+	// backoffDelay) also takes r.mu, and holding it across a store.Update
+	// round-trip would serialize all of that cluster-wide restart
+	// bookkeeping behind this one call. tuples was already snapshotted
+	// out of r.historyByService above, so it's safe to range over here.
+	err := r.store.Update(func(tx store.Tx) error {
+		for t := range tuples {
+			if err := store.DeleteRestartHistory(tx, restartHistoryID(t)); err != nil && err != store.ErrNotExist {
+				return err
+			}
+		}
+		return r.clearServiceDegraded(tx, serviceID)
+	})
+	if err != nil {
+		log.L.WithError(err).WithField("service.id", serviceID).Error("failed to delete persisted restart history")
+	}
+}
+
+// restartHistoryID returns the raft store object ID used to persist restart
+// bookkeeping for tuple. It is deterministic, so any manager that becomes
+// leader can look up the same object for a given instance.
+func restartHistoryID(tuple instanceTuple) string {
+	return fmt.Sprintf("%s/%d/%s", tuple.serviceID, tuple.instance, tuple.nodeID)
+}
+
+// persistHistory writes info to the raft-replicated RestartHistory object
+// for tuple, creating it if this is the first time the instance has
+// restarted or been reported unhealthy.
+func (r *RestartSupervisor) persistHistory(tx store.Tx, tuple instanceTuple, info *instanceRestartInfo) error {
+	r.mu.Lock()
+	h := &api.RestartHistory{
+		ID:                  restartHistoryID(tuple),
+		ServiceID:           tuple.serviceID,
+		Instance:            tuple.instance,
+		NodeID:              tuple.nodeID,
+		TotalRestarts:       info.totalRestarts,
+		ConsecutiveFailures: info.consecutiveFailures,
+		RestartedAt:         restartedTimestamps(info.restartedInstances),
+		UnhealthyReportedAt: unhealthyTimestamps(info.unhealthyReports),
+	}
+	r.mu.Unlock()
+
+	if store.GetRestartHistory(tx, h.ID) == nil {
+		return store.CreateRestartHistory(tx, h)
+	}
+	return store.UpdateRestartHistory(tx, h)
+}
+
+func restartedTimestamps(l *list.List) []time.Time {
+	if l == nil {
+		return nil
+	}
+	timestamps := make([]time.Time, 0, l.Len())
+	for e := l.Front(); e != nil; e = e.Next() {
+		timestamps = append(timestamps, e.Value.(restartedInstance).timestamp)
+	}
+	return timestamps
+}
+
+func unhealthyTimestamps(l *list.List) []time.Time {
+	if l == nil {
+		return nil
+	}
+	timestamps := make([]time.Time, 0, l.Len())
+	for e := l.Front(); e != nil; e = e.Next() {
+		timestamps = append(timestamps, e.Value.(unhealthyReport).timestamp)
+	}
+	return timestamps
+}
+
+func allBefore(timestamps []time.Time, cutoff time.Time) bool {
+	for _, ts := range timestamps {
+		if ts.After(cutoff) {
+			return false
+		}
+	}
+	return true
+}
+
+// Init rebuilds the in-memory restart-history cache from the
+// raft-replicated RestartHistory objects in the store. Start calls it with
+// a read transaction taken after a manager acquires leadership, before
+// starting anything that could read the cache, since the cache that
+// shouldRestart/recordRestartHistory operate on does not itself survive a
+// leader change. Clusters upgrading from a version of
+// swarmkit that kept this bookkeeping in memory only simply have no
+// RestartHistory objects yet, so Init leaves the cache empty for them,
+// exactly as NewRestartSupervisor used to — restart accounting starts over
+// after the upgrade rather than requiring an explicit migration step.
+func (r *RestartSupervisor) Init(readTx store.ReadTx) error {
+	histories, err := store.FindRestartHistory(readTx, store.All)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.history = make(map[instanceTuple]*instanceRestartInfo)
+	r.historyByService = make(map[string]map[instanceTuple]struct{})
+
+	for _, h := range histories {
+		tuple := instanceTuple{
+			instance:  h.Instance,
+			serviceID: h.ServiceID,
+			nodeID:    h.NodeID,
+		}
+
+		info := &instanceRestartInfo{
+			totalRestarts:       h.TotalRestarts,
+			consecutiveFailures: h.ConsecutiveFailures,
+		}
+
+		if len(h.RestartedAt) != 0 {
+			info.restartedInstances = list.New()
+			for _, ts := range h.RestartedAt {
+				info.restartedInstances.PushBack(restartedInstance{timestamp: ts})
+			}
+		}
+		if len(h.UnhealthyReportedAt) != 0 {
+			info.unhealthyReports = list.New()
+			for _, ts := range h.UnhealthyReportedAt {
+				info.unhealthyReports.PushBack(unhealthyReport{timestamp: ts})
+			}
+		}
+
+		r.history[tuple] = info
+
+		if r.historyByService[tuple.serviceID] == nil {
+			r.historyByService[tuple.serviceID] = make(map[instanceTuple]struct{})
+		}
+		r.historyByService[tuple.serviceID][tuple] = struct{}{}
+	}
+
+	return nil
+}
+
+// Run prunes RestartHistory objects whose entries have all aged out of
+// their service's Restart.Window, so the store doesn't accumulate restart
+// bookkeeping forever for long-lived clusters. It blocks until ctx is
+// cancelled; Start runs it in its own goroutine for the lifetime of the
+// supervisor, after Init has rebuilt the in-memory cache.
+func (r *RestartSupervisor) Run(ctx context.Context) {
+	ticker := time.NewTicker(restartHistorySweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.sweep(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *RestartSupervisor) sweep(ctx context.Context) {
+	err := r.store.Update(func(tx store.Tx) error {
+		histories, err := store.FindRestartHistory(tx, store.All)
+		if err != nil {
+			return err
+		}
+
+		for _, h := range histories {
+			service := store.GetService(tx, h.ServiceID)
+			if service == nil || service.Spec.Restart == nil || service.Spec.Restart.Window == 0 {
+				continue
+			}
+
+			lookback := time.Now().Add(-service.Spec.Restart.Window)
+			if !allBefore(h.RestartedAt, lookback) || !allBefore(h.UnhealthyReportedAt, lookback) {
+				continue
+			}
+
+			if err := store.DeleteRestartHistory(tx, h.ID); err != nil {
+				return err
+			}
+
+			tuple := instanceTuple{instance: h.Instance, serviceID: h.ServiceID, nodeID: h.NodeID}
+
+			r.mu.Lock()
+			delete(r.history, tuple)
+			if tuples := r.historyByService[h.ServiceID]; tuples != nil {
+				delete(tuples, tuple)
+			}
+			r.mu.Unlock()
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to sweep expired restart history")
+	}
+}
@@ -0,0 +1,332 @@
+package orchestrator
+
+import (
+	"container/list"
+	"testing"
+	"time"
+
+	"github.com/docker/swarm-v2/api"
+	"github.com/docker/swarm-v2/manager/state/store"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// TestRestartOnUnhealthy verifies that a task which stays TaskStateRunning
+// but is repeatedly reported unhealthy gets replaced once the number of
+// reports reaches the container's HealthConfig.Retries, and not before.
+func TestRestartOnUnhealthy(t *testing.T) {
+	s := store.NewMemoryStore(nil)
+	assert.NotNil(t, s)
+
+	service := &api.Service{
+		ID: "serviceid1",
+		Spec: api.ServiceSpec{
+			Mode: &api.ServiceSpec_Replicated{Replicated: &api.ReplicatedService{}},
+			Task: api.TaskSpec{
+				Runtime: &api.TaskSpec_Container{
+					Container: &api.ContainerSpec{
+						HealthConfig: &api.HealthConfig{
+							Retries: 2,
+						},
+					},
+				},
+			},
+			Restart: &api.RestartPolicy{
+				Condition: api.RestartOnUnhealthy,
+				Window:    time.Minute,
+			},
+		},
+	}
+
+	task := &api.Task{
+		ID:        "taskid1",
+		ServiceID: service.ID,
+		Instance:  0,
+		Status: api.TaskStatus{
+			State: api.TaskStateRunning,
+		},
+	}
+
+	err := s.Update(func(tx store.Tx) error {
+		if err := store.CreateService(tx, service); err != nil {
+			return err
+		}
+		return store.CreateTask(tx, task)
+	})
+	assert.NoError(t, err)
+
+	r := NewRestartSupervisor(s)
+	defer r.Stop()
+
+	ctx := context.Background()
+
+	// A single unhealthy report shouldn't trigger a restart yet: Retries
+	// is 2.
+	r.handleUnhealthyTask(ctx, task)
+
+	s.View(func(tx store.ReadTx) {
+		tasks, err := store.FindTasks(tx, store.ByServiceID(service.ID))
+		assert.NoError(t, err)
+		assert.Len(t, tasks, 1)
+	})
+
+	// The second report reaches the retry threshold and should cause the
+	// task to be replaced.
+	r.handleUnhealthyTask(ctx, task)
+
+	s.View(func(tx store.ReadTx) {
+		tasks, err := store.FindTasks(tx, store.ByServiceID(service.ID))
+		assert.NoError(t, err)
+		assert.Len(t, tasks, 2)
+
+		var oldTask, newTask *api.Task
+		for _, tsk := range tasks {
+			if tsk.ID == task.ID {
+				oldTask = tsk
+			} else {
+				newTask = tsk
+			}
+		}
+
+		assert.NotNil(t, oldTask)
+		assert.Equal(t, api.TaskStateShutdown, oldTask.DesiredState)
+
+		assert.NotNil(t, newTask)
+		assert.Equal(t, uint64(0), newTask.Instance)
+	})
+}
+
+// TestDefaultRestartPolicyEvaluator covers the three configurations
+// defaultRestartPolicyEvaluator.Evaluate needs to tell apart: no limit at
+// all, a limit with no window (lifetime count), and a limit scoped to a
+// window (count of restartedInstances, which the caller is responsible for
+// keeping pruned to that window).
+func TestDefaultRestartPolicyEvaluator(t *testing.T) {
+	e := defaultRestartPolicyEvaluator{}
+	tuple := instanceTuple{instance: 0, serviceID: "serviceid1"}
+
+	// MaxAttempts == 0 always allows, regardless of how many restarts have
+	// already happened.
+	service := &api.Service{Spec: api.ServiceSpec{Restart: &api.RestartPolicy{MaxAttempts: 0}}}
+	allow, exceeded := e.Evaluate(tuple, service, &instanceRestartInfo{totalRestarts: 1000})
+	assert.True(t, allow)
+	assert.False(t, exceeded)
+
+	// No window: a lifetime counter against MaxAttempts.
+	service = &api.Service{Spec: api.ServiceSpec{Restart: &api.RestartPolicy{MaxAttempts: 3}}}
+	allow, exceeded = e.Evaluate(tuple, service, &instanceRestartInfo{totalRestarts: 2})
+	assert.True(t, allow)
+	assert.False(t, exceeded)
+
+	allow, exceeded = e.Evaluate(tuple, service, &instanceRestartInfo{totalRestarts: 3})
+	assert.False(t, allow)
+	assert.True(t, exceeded)
+
+	// With a window, Evaluate counts restartedInstances rather than
+	// totalRestarts. It trusts that list to have already been pruned to
+	// the window by the caller (shouldRestart), so entries outside
+	// the window still count here if present.
+	service = &api.Service{Spec: api.ServiceSpec{Restart: &api.RestartPolicy{MaxAttempts: 2, Window: time.Minute}}}
+	history := &instanceRestartInfo{restartedInstances: list.New()}
+	history.restartedInstances.PushBack(restartedInstance{timestamp: time.Now()})
+	allow, exceeded = e.Evaluate(tuple, service, history)
+	assert.True(t, allow)
+	assert.False(t, exceeded)
+
+	history.restartedInstances.PushBack(restartedInstance{timestamp: time.Now()})
+	allow, exceeded = e.Evaluate(tuple, service, history)
+	assert.False(t, allow)
+	assert.True(t, exceeded)
+}
+
+// TestRateLimitedRestartPolicyEvaluator verifies that the cluster-wide
+// per-minute budget is enforced independently of, and in addition to, the
+// delegate evaluator's per-instance decision.
+func TestRateLimitedRestartPolicyEvaluator(t *testing.T) {
+	e := NewRateLimitedRestartPolicyEvaluator(2, defaultRestartPolicyEvaluator{})
+
+	// MaxAttempts == 0 means the delegate always allows, so only the
+	// rate limiter's own budget matters here.
+	service := &api.Service{Spec: api.ServiceSpec{Restart: &api.RestartPolicy{MaxAttempts: 0}}}
+	tuple := instanceTuple{instance: 0, serviceID: "serviceid1"}
+	info := &instanceRestartInfo{}
+
+	allow, exceeded := e.Evaluate(tuple, service, info)
+	assert.True(t, allow)
+	assert.False(t, exceeded)
+
+	allow, exceeded = e.Evaluate(tuple, service, info)
+	assert.True(t, allow)
+	assert.False(t, exceeded)
+
+	// Third restart within the same minute, across any instance of the
+	// service, exceeds MaxPerMinute even though nothing here ever exceeds
+	// its own per-instance MaxAttempts.
+	allow, exceeded = e.Evaluate(instanceTuple{instance: 1, serviceID: "serviceid1"}, service, info)
+	assert.False(t, allow)
+	assert.True(t, exceeded)
+
+	// A different service gets its own independent budget.
+	otherTuple := instanceTuple{instance: 0, serviceID: "serviceid2"}
+	allow, exceeded = e.Evaluate(otherTuple, service, info)
+	assert.True(t, allow)
+	assert.False(t, exceeded)
+}
+
+// TestBackoffDelay verifies the exponential backoff math, including the
+// MaxDelay cap, with JitterFraction at zero so the result is deterministic.
+func TestBackoffDelay(t *testing.T) {
+	s := store.NewMemoryStore(nil)
+	r := NewRestartSupervisor(s)
+	defer r.Stop()
+
+	service := &api.Service{
+		Spec: api.ServiceSpec{
+			Restart: &api.RestartPolicy{
+				Delay:         time.Second,
+				BackoffFactor: 2,
+				MaxDelay:      5 * time.Second,
+			},
+		},
+	}
+	tuple := instanceTuple{instance: 0, serviceID: "serviceid1"}
+
+	// No failures recorded yet: delay is just the base Delay.
+	assert.Equal(t, time.Second, r.backoffDelay(service, tuple))
+
+	r.mu.Lock()
+	r.history[tuple] = &instanceRestartInfo{consecutiveFailures: 2}
+	r.mu.Unlock()
+	assert.Equal(t, 4*time.Second, r.backoffDelay(service, tuple))
+
+	// Would be 8s uncapped, but MaxDelay caps it at 5s.
+	r.mu.Lock()
+	r.history[tuple].consecutiveFailures = 3
+	r.mu.Unlock()
+	assert.Equal(t, 5*time.Second, r.backoffDelay(service, tuple))
+}
+
+// TestServiceDegradedMarkAndClear covers the full restarts-exceeded
+// lifecycle: an instance exceeding Restart.MaxAttempts marks the service
+// degraded, and ClearServiceHistory (an operator-driven reset) clears that
+// mark again rather than leaving it stuck forever.
+func TestServiceDegradedMarkAndClear(t *testing.T) {
+	s := store.NewMemoryStore(nil)
+	assert.NotNil(t, s)
+
+	service := &api.Service{
+		ID: "serviceid1",
+		Spec: api.ServiceSpec{
+			Restart: &api.RestartPolicy{
+				Condition:   api.RestartOnFailure,
+				MaxAttempts: 1,
+			},
+		},
+	}
+
+	task := &api.Task{ID: "taskid1", ServiceID: service.ID, Instance: 0}
+
+	err := s.Update(func(tx store.Tx) error {
+		if err := store.CreateService(tx, service); err != nil {
+			return err
+		}
+		return store.CreateTask(tx, task)
+	})
+	assert.NoError(t, err)
+
+	r := NewRestartSupervisor(s)
+	defer r.Stop()
+
+	tuple := instanceTuple{instance: 0, serviceID: service.ID}
+
+	err = s.Update(func(tx store.Tx) error {
+		return r.markRestartsExceeded(context.Background(), tx, service, task)
+	})
+	assert.NoError(t, err)
+
+	s.View(func(tx store.ReadTx) {
+		current := store.GetService(tx, service.ID)
+		assert.NotNil(t, current.Status)
+		assert.Equal(t, api.ServiceStateDegraded, current.Status.State)
+	})
+
+	r.mu.Lock()
+	r.historyByService[service.ID] = map[instanceTuple]struct{}{tuple: {}}
+	r.history[tuple] = &instanceRestartInfo{totalRestarts: 1}
+	r.mu.Unlock()
+
+	r.ClearServiceHistory(service.ID)
+
+	s.View(func(tx store.ReadTx) {
+		current := store.GetService(tx, service.ID)
+		assert.NotNil(t, current.Status)
+		assert.Equal(t, api.ServiceStateAvailable, current.Status.State)
+	})
+}
+
+// TestInitSweep verifies that Init rebuilds the in-memory cache from
+// persisted RestartHistory objects, and that sweep subsequently prunes the
+// ones that have fully aged out of their service's Restart.Window from
+// both the store and the cache.
+func TestInitSweep(t *testing.T) {
+	s := store.NewMemoryStore(nil)
+	assert.NotNil(t, s)
+
+	service := &api.Service{
+		ID:   "serviceid1",
+		Spec: api.ServiceSpec{Restart: &api.RestartPolicy{Window: time.Minute}},
+	}
+
+	aged := &api.RestartHistory{
+		ID:            "aged",
+		ServiceID:     service.ID,
+		Instance:      0,
+		TotalRestarts: 3,
+		RestartedAt:   []time.Time{time.Now().Add(-time.Hour)},
+	}
+	fresh := &api.RestartHistory{
+		ID:            "fresh",
+		ServiceID:     service.ID,
+		Instance:      1,
+		TotalRestarts: 1,
+		RestartedAt:   []time.Time{time.Now()},
+	}
+
+	err := s.Update(func(tx store.Tx) error {
+		if err := store.CreateService(tx, service); err != nil {
+			return err
+		}
+		if err := store.CreateRestartHistory(tx, aged); err != nil {
+			return err
+		}
+		return store.CreateRestartHistory(tx, fresh)
+	})
+	assert.NoError(t, err)
+
+	r := NewRestartSupervisor(s)
+	defer r.Stop()
+
+	s.View(func(tx store.ReadTx) {
+		assert.NoError(t, r.Init(tx))
+	})
+
+	agedTuple := instanceTuple{instance: 0, serviceID: service.ID}
+	freshTuple := instanceTuple{instance: 1, serviceID: service.ID}
+
+	r.mu.Lock()
+	assert.Equal(t, uint64(3), r.history[agedTuple].totalRestarts)
+	assert.Equal(t, uint64(1), r.history[freshTuple].totalRestarts)
+	r.mu.Unlock()
+
+	r.sweep(context.Background())
+
+	s.View(func(tx store.ReadTx) {
+		assert.Nil(t, store.GetRestartHistory(tx, aged.ID))
+		assert.NotNil(t, store.GetRestartHistory(tx, fresh.ID))
+	})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	assert.Nil(t, r.history[agedTuple])
+	assert.NotNil(t, r.history[freshTuple])
+}